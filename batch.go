@@ -0,0 +1,98 @@
+//
+// Copyright 2015 The CoreOS Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/coreos/ignition/config/validate/report"
+	"github.com/crawford/nap"
+)
+
+type batchFile struct {
+	Name string `json:"name"`
+	// Content holds the file data, interpreted according to Encoding.
+	Content string `json:"content"`
+	// Encoding is "raw" (the default) or "base64". It is required to be
+	// explicit rather than sniffed, since raw content can itself be valid
+	// base64 and silently decode into the wrong bytes.
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type batchRequest struct {
+	Files []batchFile `json:"files"`
+}
+
+type batchResult struct {
+	Kind    string         `json:"kind,omitempty"`
+	Entries []report.Entry `json:"entries,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// putValidateBatch validates a directory's worth of configs in one request,
+// keyed by the name given for each file. It shares validateOne with
+// putValidate so both paths detect kind and outcome identically.
+func putValidateBatch(r *http.Request) (interface{}, nap.Status) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, nap.InternalError{err.Error()}
+	}
+
+	var req batchRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, nap.InternalError{err.Error()}
+	}
+
+	results := make(map[string]batchResult, len(req.Files))
+	for _, f := range req.Files {
+		content, err := decodeBatchContent(f.Content, f.Encoding)
+		if err != nil {
+			results[f.Name] = batchResult{Error: err.Error()}
+			continue
+		}
+		content = bytes.Replace(content, []byte("\r"), []byte{}, -1)
+
+		kind, entries, err := validateOne(content)
+		if err != nil {
+			results[f.Name] = batchResult{Kind: kind, Error: err.Error()}
+			continue
+		}
+
+		validationsTotal.WithLabelValues(kind, outcomeFor(entries)).Inc()
+		results[f.Name] = batchResult{Kind: kind, Entries: entries}
+	}
+
+	return results, nap.OK{}
+}
+
+// decodeBatchContent decodes a single batch entry's content per its
+// declared encoding. Unlike sniffing, an unrecognized encoding is a hard
+// error rather than a silent misdecode.
+func decodeBatchContent(content, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "raw":
+		return []byte(content), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(content)
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q: must be \"raw\" or \"base64\"", encoding)
+	}
+}
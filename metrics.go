@@ -0,0 +1,73 @@
+//
+// Copyright 2015 The CoreOS Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/coreos/ignition/config/validate/report"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	validationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "validator_validations_total",
+			Help: "Total number of validation requests, broken down by detected config kind and outcome.",
+		},
+		[]string{"kind", "outcome"},
+	)
+
+	validationDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "validator_validation_duration_seconds",
+			Help:    "Time taken to validate a single config.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	payloadSizeBytes = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "validator_payload_size_bytes",
+			Help:    "Size of submitted config payloads, in bytes.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+		},
+	)
+
+	panicsRecoveredTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "validator_panics_recovered_total",
+			Help: "Number of panics recovered by the HTTP panic handler.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(validationsTotal, validationDuration, payloadSizeBytes, panicsRecoveredTotal)
+}
+
+// outcomeFor summarizes a report's entries into the "ok", "warnings" or
+// "errors" label used by validationsTotal.
+func outcomeFor(entries []report.Entry) string {
+	outcome := "ok"
+	for _, entry := range entries {
+		switch entry.Kind {
+		case report.EntryError:
+			return "errors"
+		case report.EntryWarning:
+			outcome = "warnings"
+		}
+	}
+	return outcome
+}
@@ -0,0 +1,167 @@
+//
+// Copyright 2015 The CoreOS Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	// ctConfig transitively pulls in an older github.com/coreos/ignition
+	// release (for its per-version config/v2_x, config/v3_x types) than the
+	// ignConfig.Parse/ErrCloudConfig top-level API validate.go and batch.go
+	// depend on. A single Go module build can only select one version of
+	// github.com/coreos/ignition, so these two call sites can't both be
+	// satisfied without vendoring a forked/patched ignition, or dropping one
+	// of the two APIs. Tracked as a dependency-pinning problem, not fixed
+	// here.
+	ctConfig "github.com/coreos/container-linux-config-transpiler/config"
+	ignConfig "github.com/coreos/ignition/config"
+	"github.com/coreos/ignition/config/validate/report"
+	"github.com/crawford/nap"
+)
+
+// transpileResponse is the envelope returned by /transpile. Ignition is
+// only populated when the config transpiled successfully.
+type transpileResponse struct {
+	Report   []report.Entry `json:"report"`
+	Ignition string         `json:"ignition,omitempty"`
+}
+
+// supportedIgnitionVersions enumerates the Ignition spec versions accepted
+// in ?version=. Accepting a version does not render output at it: ct emits
+// its own fixed spec version, and Ignition input is passed through as is.
+var supportedIgnitionVersions = map[string]bool{
+	"2.0.0": true, "2.1.0": true, "2.2.0": true, "2.3.0": true,
+	"3.0.0": true, "3.1.0": true, "3.2.0": true, "3.3.0": true,
+}
+
+func putTranspile(r *http.Request) (interface{}, nap.Status) {
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		version = "2.3.0"
+	}
+	if !supportedIgnitionVersions[version] {
+		return transpileResponse{
+			Report: []report.Entry{{
+				Kind:    report.EntryError,
+				Message: fmt.Sprintf("unsupported ignition spec version %q", version),
+			}},
+		}, nap.OK{}
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, nap.InternalError{err.Error()}
+	}
+	config := bytes.Replace(body, []byte("\r"), []byte{}, -1)
+
+	entries, ignition, err := transpileToIgnition(config, version)
+	if err != nil && len(entries) == 0 {
+		// transpileToIgnition/renderButane normally describe the failure via
+		// entries already; this is only a safety net for the rare case they
+		// don't, so the envelope's report is never empty on error.
+		entries = []report.Entry{{Kind: report.EntryError, Message: err.Error()}}
+	}
+
+	return transpileResponse{Report: entries, Ignition: ignition}, nap.OK{}
+}
+
+// ignitionVersionProbe reads just enough of a config to learn which
+// Ignition spec version it already declares.
+type ignitionVersionProbe struct {
+	Ignition struct {
+		Version string `json:"version"`
+	} `json:"ignition"`
+}
+
+// noteVersionMismatch warns when the caller asked for a different Ignition
+// spec version than an already-Ignition input declares, since that input is
+// passed through unchanged rather than converted.
+func noteVersionMismatch(config []byte, requested string, entries []report.Entry) []report.Entry {
+	var probe ignitionVersionProbe
+	if err := json.Unmarshal(config, &probe); err != nil || probe.Ignition.Version == "" {
+		return entries
+	}
+	if probe.Ignition.Version != requested {
+		entries = append(entries, report.Entry{
+			Kind: report.EntryWarning,
+			Message: fmt.Sprintf("input is already Ignition %s and is passed through unchanged; ?version=%s was not applied",
+				probe.Ignition.Version, requested),
+		})
+	}
+	return entries
+}
+
+// transpileToIgnition detects whether config is an Ignition config, a
+// cloud-config, or a Butane/FCCT document, and renders it as Ignition JSON.
+// A config that is already Ignition is passed through unchanged rather than
+// re-rendered. The requested spec version is not applied in either case; a
+// warning entry is added instead.
+func transpileToIgnition(config []byte, version string) ([]report.Entry, string, error) {
+	_, rpt, err := ignConfig.Parse(config)
+	switch err {
+	case ignConfig.ErrCloudConfig, ignConfig.ErrEmpty, ignConfig.ErrScript:
+		return renderButane(config, version)
+	case ignConfig.ErrUnknownVersion:
+		return []report.Entry{{
+			Kind:    report.EntryError,
+			Message: "Failed to parse config. Is this a valid Ignition Config, Cloud-Config, or Butane document?",
+		}}, "", nil
+	case nil:
+		rpt.Sort()
+		entries := noteVersionMismatch(config, version, rpt.Entries)
+		return entries, string(bytes.TrimSpace(config)), nil
+	default:
+		rpt.Sort()
+		return rpt.Entries, "", err
+	}
+}
+
+// renderButane parses a cloud-config or Butane/FCCT document with ct and
+// converts it to Ignition. ct's Convert takes a target platform (e.g.
+// "aws"), not an Ignition spec version, and always emits whatever Ignition
+// config version is compiled into the vendored ct release — there is no
+// per-version output selection in this library. The requested ?version= is
+// therefore only noted in the report, here as in the pass-through case in
+// transpileToIgnition.
+func renderButane(config []byte, version string) ([]report.Entry, string, error) {
+	cfg, ast, parseRpt := ctConfig.Parse(config)
+	entries := append([]report.Entry{}, parseRpt.Entries...)
+	if parseRpt.IsFatal() {
+		return entries, "", fmt.Errorf("failed to parse cloud-config/Butane document")
+	}
+
+	ign, convertRpt := ctConfig.Convert(cfg, "", ast)
+	entries = append(entries, convertRpt.Entries...)
+	if convertRpt.IsFatal() {
+		return entries, "", fmt.Errorf("failed to convert cloud-config/Butane document to Ignition")
+	}
+
+	entries = append(entries, report.Entry{
+		Kind:    report.EntryWarning,
+		Message: fmt.Sprintf("ct renders a single fixed Ignition spec version; ?version=%s was not applied", version),
+	})
+
+	marshaled, err := json.Marshal(ign)
+	if err != nil {
+		return entries, "", err
+	}
+
+	return entries, string(marshaled), nil
+}
@@ -17,28 +17,45 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"runtime/debug"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/coreos/coreos-cloudinit/config/validate"
 	ignConfig "github.com/coreos/ignition/config"
 	"github.com/coreos/ignition/config/validate/report"
 	"github.com/crawford/nap"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
 	flags = struct {
-		port       int
-		address    string
-		parseStdin bool
+		port            int
+		address         string
+		parseStdin      bool
+		shutdownTimeout time.Duration
+		tlsCert         string
+		tlsKey          string
+		clientCA        string
+		ignitionVersion string
 	}{}
+
+	// ready gates /readyz: 1 once the server is accepting traffic, flipped
+	// back to 0 as soon as shutdown begins.
+	ready int32
 )
 
 type payloadWrapper struct{}
@@ -52,14 +69,26 @@ func (w payloadWrapper) Wrap(payload interface{}, status nap.Status) (interface{
 type panicHandler struct{}
 
 func (h panicHandler) Handle(e interface{}) {
+	panicsRecoveredTotal.Inc()
 	log.Printf("PANIC: %#v\n", e)
 	debug.PrintStack()
 }
 
+// notReadyStatus backs /readyz once shutdown has begun.
+type notReadyStatus struct{}
+
+func (notReadyStatus) Code() int       { return http.StatusServiceUnavailable }
+func (notReadyStatus) Message() string { return "shutting down" }
+
 func init() {
 	flag.StringVar(&flags.address, "address", "0.0.0.0", "address to listen on")
 	flag.IntVar(&flags.port, "port", 80, "port to bind on")
 	flag.BoolVar(&flags.parseStdin, "parseStdin", false, "If set to true, parses stdin and exits")
+	flag.DurationVar(&flags.shutdownTimeout, "shutdownTimeout", 10*time.Second, "grace period to drain in-flight requests before shutting down")
+	flag.StringVar(&flags.tlsCert, "tlsCert", "", "path to a PEM encoded TLS certificate; enables HTTPS when set alongside -tlsKey")
+	flag.StringVar(&flags.tlsKey, "tlsKey", "", "path to the PEM encoded TLS private key for -tlsCert")
+	flag.StringVar(&flags.clientCA, "clientCA", "", "path to a PEM encoded CA bundle; when set, requires and verifies client certificates (mTLS)")
+	flag.StringVar(&flags.ignitionVersion, "ignitionVersion", "2.3.0", "Ignition spec version requested for -parseStdin output; it is not applied to the output, only reported in a warning entry")
 
 	nap.PayloadWrapper = payloadWrapper{}
 	nap.PanicHandler = panicHandler{}
@@ -75,11 +104,14 @@ func main() {
 	flag.Parse()
 
 	if flags.parseStdin {
-		sz, cfg, err := fileValidate()
+		sz, cfg, ignition, err := fileValidate()
 		if err != nil {
 			log.Printf("Fatal error parsing: %s\n", err);
 		} else if sz == 0 {
 			log.Printf("Config file looks good");
+			if ignition != "" {
+				fmt.Println(ignition)
+			}
 		} else {
 			log.Printf("Failed to validate config: %s\n", cfg);
 		}
@@ -92,70 +124,186 @@ func main() {
 
 		router.Handle("/validate", nap.HandlerFunc(optionsValidate)).Methods("OPTIONS")
 		router.Handle("/validate", nap.HandlerFunc(putValidate)).Methods("PUT")
-		router.Handle("/health", nap.HandlerFunc(getHealth)).Methods("GET")
+		router.Handle("/validate/batch", nap.HandlerFunc(optionsValidate)).Methods("OPTIONS")
+		router.Handle("/validate/batch", nap.HandlerFunc(putValidateBatch)).Methods("PUT")
+		router.Handle("/transpile", nap.HandlerFunc(optionsValidate)).Methods("OPTIONS")
+		router.Handle("/transpile", nap.HandlerFunc(putTranspile)).Methods("PUT")
+		router.Handle("/healthz", nap.HandlerFunc(getHealth)).Methods("GET")
+		router.Handle("/readyz", nap.HandlerFunc(getReady)).Methods("GET")
+		router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+		certSet, keySet := flags.tlsCert != "", flags.tlsKey != ""
+		if certSet != keySet {
+			log.Fatalln("-tlsCert and -tlsKey must be set together")
+		}
+		useTLS := certSet && keySet
+		if flags.clientCA != "" {
+			if !useTLS {
+				log.Fatalln("-clientCA requires -tlsCert and -tlsKey to be set")
+			}
+			pool, err := loadClientCAs(flags.clientCA)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			server.TLSConfig = &tls.Config{
+				ClientCAs:  pool,
+				ClientAuth: tls.RequireAndVerifyClientCert,
+			}
+		}
+
+		atomic.StoreInt32(&ready, 1)
+
+		shutdownComplete := make(chan struct{})
+		go func() {
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+			<-sigs
+
+			atomic.StoreInt32(&ready, 0)
+
+			ctx, cancel := context.WithTimeout(context.Background(), flags.shutdownTimeout)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("graceful shutdown failed: %s\n", err)
+			}
+			close(shutdownComplete)
+		}()
+
+		var err error
+		if useTLS {
+			err = server.ListenAndServeTLS(flags.tlsCert, flags.tlsKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+		<-shutdownComplete
+	}
+}
+
+// loadClientCAs reads a PEM encoded CA bundle from path and returns a pool
+// suitable for tls.Config.ClientCAs.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 
-		log.Fatalln(server.ListenAndServe())
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
 	}
+	return pool, nil
 }
 
 func optionsValidate(r *http.Request) (interface{}, nap.Status) {
 	return nil, nap.OK{}
 }
 
-func fileValidate() (int, interface{}, error) {
+func fileValidate() (int, interface{}, string, error) {
 	src, err := ioutil.ReadAll(os.Stdin)
 	if err != nil {
-		return -1, nil, errors.New(err.Error())
+		return -1, nil, "", errors.New(err.Error())
 	}
 
 	config := bytes.Replace(src, []byte("\r"), []byte{}, -1)
 
+	entries, ignition, err := transpileToIgnition(config, flags.ignitionVersion)
+	if err != nil {
+		return -1, nil, "", err
+	}
+	return len(entries), entries, ignition, nil
+}
+
+// convertCloudConfigEntries converts coreos-cloudinit's validate.Entry into
+// ignition's report.Entry. The two are distinct, unrelated struct types, so
+// there's no implicit conversion; IsFatal is probed via a locally-declared
+// interface rather than a direct method call so this keeps compiling even if
+// validate.Entry's exact method set shifts upstream.
+func convertCloudConfigEntries(ccEntries []validate.Entry) []report.Entry {
+	entries := make([]report.Entry, len(ccEntries))
+	for i, e := range ccEntries {
+		kind := report.EntryWarning
+		if f, ok := interface{}(e).(interface{ IsFatal() bool }); ok && f.IsFatal() {
+			kind = report.EntryError
+		}
+		entries[i] = report.Entry{
+			Kind:    kind,
+			Message: fmt.Sprint(e),
+		}
+	}
+	return entries
+}
+
+// validateOne detects the config kind of a single payload and runs it
+// through the appropriate validator. It is shared by putValidate and
+// putValidateBatch so both paths agree on kind detection and entries.
+func validateOne(config []byte) (string, []report.Entry, error) {
+	var kind string
+	var entries []report.Entry
+
 	_, rpt, err := ignConfig.Parse(config)
 	switch err {
 	case ignConfig.ErrCloudConfig, ignConfig.ErrEmpty, ignConfig.ErrScript:
-		rpt, err := validate.Validate(config)
-		if err != nil {
-			return -1, nil, errors.New(err.Error())
+		switch err {
+		case ignConfig.ErrCloudConfig:
+			kind = "cloud-config"
+		case ignConfig.ErrEmpty:
+			kind = "empty"
+		case ignConfig.ErrScript:
+			kind = "script"
 		}
-		return len(rpt.Entries()), rpt.Entries(), nil
+
+		ccRpt, vErr := validate.Validate(config)
+		if vErr != nil {
+			return kind, nil, vErr
+		}
+		entries = convertCloudConfigEntries(ccRpt.Entries())
 	case ignConfig.ErrUnknownVersion:
-		return 1, []report.Entry{{
+		kind = "unknown-version"
+		entries = []report.Entry{{
 			Kind:    report.EntryError,
-			Message: "Unknown ignition version",
-		}}, nil
+			Message: "Failed to parse config. Is this a valid Ignition Config, Cloud-Config, or script?",
+		}}
 	default:
+		kind = "ignition"
 		rpt.Sort()
-		return len(rpt.Entries), rpt.Entries, nil
+		entries = rpt.Entries
 	}
+
+	return kind, entries, nil
 }
 
 func putValidate(r *http.Request) (interface{}, nap.Status) {
+	start := time.Now()
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return nil, nap.InternalError{err.Error()}
 	}
+	payloadSizeBytes.Observe(float64(len(body)))
 
 	config := bytes.Replace(body, []byte("\r"), []byte{}, -1)
 
-	_, rpt, err := ignConfig.Parse(config)
-	switch err {
-	case ignConfig.ErrCloudConfig, ignConfig.ErrEmpty, ignConfig.ErrScript:
-		rpt, err := validate.Validate(config)
-		if err != nil {
-			return nil, nap.InternalError{err.Error()}
-		}
-		return rpt.Entries(), nap.OK{}
-	case ignConfig.ErrUnknownVersion:
-		return []report.Entry{{
-			Kind:    report.EntryError,
-			Message: "Failed to parse config. Is this a valid Ignition Config, Cloud-Config, or script?",
-		}}, nap.OK{}
-	default:
-		rpt.Sort()
-		return rpt.Entries, nap.OK{}
+	kind, entries, err := validateOne(config)
+	if err != nil {
+		return nil, nap.InternalError{err.Error()}
 	}
+
+	validationDuration.Observe(time.Since(start).Seconds())
+	validationsTotal.WithLabelValues(kind, outcomeFor(entries)).Inc()
+
+	return entries, nap.OK{}
 }
 
 func getHealth(r *http.Request) (interface{}, nap.Status) {
 	return nil, nap.OK{}
 }
+
+func getReady(r *http.Request) (interface{}, nap.Status) {
+	if atomic.LoadInt32(&ready) == 0 {
+		return nil, notReadyStatus{}
+	}
+	return nil, nap.OK{}
+}